@@ -0,0 +1,204 @@
+package loom
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startFakeSSHServer listens on 127.0.0.1:0, accepts connections, and completes a real (but
+// authless) SSH handshake on each one. dials is incremented once per accepted connection, so
+// tests can assert on how many times a Config actually opened a new TCP connection.
+func startFakeSSHServer(t *testing.T) (addr string, dials *int32, stop func()) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("wrapping host key: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	var dialCount int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&dialCount, 1)
+			go func() {
+				sconn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(reqs)
+				go func() {
+					for newChannel := range chans {
+						newChannel.Reject(ssh.Prohibited, "no channels in this test")
+					}
+				}()
+				sconn.Wait()
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), &dialCount, func() { listener.Close() }
+}
+
+func TestConnectClientCachesConnection(t *testing.T) {
+	addr, dials, stop := startFakeSSHServer(t)
+	defer stop()
+
+	config := Config{
+		Host:            addr,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	client1, err := config.connectClient()
+	if err != nil {
+		t.Fatalf("first connectClient: %s", err)
+	}
+	if got := atomic.LoadInt32(dials); got != 1 {
+		t.Errorf("expected 1 dial after first connectClient, got %d", got)
+	}
+
+	client2, err := config.connectClient()
+	if err != nil {
+		t.Fatalf("second connectClient: %s", err)
+	}
+	if client1 != client2 {
+		t.Errorf("expected connectClient to return the cached client")
+	}
+	if got := atomic.LoadInt32(dials); got != 1 {
+		t.Errorf("expected connectClient to reuse the connection, but dialed again (count %d)", got)
+	}
+}
+
+func TestConnectClientRedialsAfterClose(t *testing.T) {
+	addr, dials, stop := startFakeSSHServer(t)
+	defer stop()
+
+	config := Config{
+		Host:            addr,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	if _, err := config.connectClient(); err != nil {
+		t.Fatalf("first connectClient: %s", err)
+	}
+	if err := config.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if _, err := config.connectClient(); err != nil {
+		t.Fatalf("connectClient after Close: %s", err)
+	}
+	if got := atomic.LoadInt32(dials); got != 2 {
+		t.Errorf("expected a fresh dial after Close, got %d total dials", got)
+	}
+}
+
+// testPublicKey generates a fresh RSA key pair and returns just the public half, in the form
+// knownHostsCallback's callback receives it.
+func testPublicKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("wrapping public key: %s", err)
+	}
+	return pub
+}
+
+func TestKnownHostsCallbackRejectsUnknownHostByDefault(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	config := Config{KnownHostsFiles: []string{knownHosts}}
+
+	callback, err := config.knownHostsCallback()
+	if err != nil {
+		t.Fatalf("knownHostsCallback: %s", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+	if err := callback("example.com:22", addr, testPublicKey(t)); err == nil {
+		t.Errorf("expected an unknown host to be rejected under the default StrictHostKeyChecking")
+	}
+}
+
+func TestKnownHostsCallbackAcceptsAndAppendsUnknownHostWhenNotStrict(t *testing.T) {
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	config := Config{KnownHostsFiles: []string{knownHosts}, StrictHostKeyChecking: "no"}
+
+	callback, err := config.knownHostsCallback()
+	if err != nil {
+		t.Fatalf("knownHostsCallback: %s", err)
+	}
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+	key := testPublicKey(t)
+	if err := callback("example.com:22", addr, key); err != nil {
+		t.Errorf("expected an unknown host to be accepted under StrictHostKeyChecking=no, got %s", err)
+	}
+
+	contents, err := os.ReadFile(knownHosts)
+	if err != nil {
+		t.Fatalf("reading known_hosts: %s", err)
+	}
+	if len(contents) == 0 {
+		t.Errorf("expected the accepted host key to be appended to %s", knownHosts)
+	}
+
+	// A second callback built from the now-populated file should recognize the host without
+	// needing to append it again.
+	callback2, err := config.knownHostsCallback()
+	if err != nil {
+		t.Fatalf("knownHostsCallback after append: %s", err)
+	}
+	if err := callback2("example.com:22", addr, key); err != nil {
+		t.Errorf("expected the now-known host to be accepted, got %s", err)
+	}
+}
+
+func TestKnownHostsCallbackRejectsMismatchedKeyRegardlessOfStrictness(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 22}
+	originalKey := testPublicKey(t)
+
+	for _, strictChecking := range []string{"yes", "no", "ask"} {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+		config := Config{KnownHostsFiles: []string{knownHosts}, StrictHostKeyChecking: "no"}
+		seed, err := config.knownHostsCallback()
+		if err != nil {
+			t.Fatalf("knownHostsCallback: %s", err)
+		}
+		if err := seed("example.com:22", addr, originalKey); err != nil {
+			t.Fatalf("seeding known_hosts: %s", err)
+		}
+
+		config.StrictHostKeyChecking = strictChecking
+		callback, err := config.knownHostsCallback()
+		if err != nil {
+			t.Fatalf("knownHostsCallback: %s", err)
+		}
+		if err := callback("example.com:22", addr, testPublicKey(t)); err == nil {
+			t.Errorf("StrictHostKeyChecking=%q: expected a mismatched host key to be rejected", strictChecking)
+		}
+	}
+}
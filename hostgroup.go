@@ -0,0 +1,157 @@
+package loom
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result carries the outcome of running one HostGroup method against a single host.
+type Result struct {
+	Stdout   string
+	Err      error
+	Duration time.Duration
+}
+
+// HostGroup runs the same task, built from Template, against a list of hosts in parallel. This
+// mirrors the Config API (Run, Sudo, Put, Get, PutString), fanning each call out across Hosts and
+// collecting one Result per host.
+type HostGroup struct {
+	// The hosts to run against, in Config.Host form (host or host:port).
+	Hosts []string
+
+	// The Config used for every host; Host is overwritten per-host, everything else (User,
+	// KeyFiles, DisplayOutput, ...) is shared.
+	Template Config
+
+	// How many hosts to run against at once. Defaults to len(Hosts), capped at maxParallel.
+	Parallel int
+
+	// If true, an error on any host cancels the context shared by every host's call (derived from
+	// Template.Context, or context.Background() if unset) so that outstanding work on the other
+	// hosts stops early. Template.Context itself is not cancelled.
+	FailFast bool
+}
+
+// maxParallel bounds Parallel, whether set explicitly or defaulted, so accidentally pointing a
+// HostGroup at a huge host list doesn't open hundreds of simultaneous SSH connections.
+const maxParallel = 32
+
+// dispatch clones Template once per host, overwrites Host, and runs action against each clone
+// through a semaphore of size Parallel.
+func (hg *HostGroup) dispatch(action func(config *Config) (string, error)) map[string]Result {
+	parallel := hg.Parallel
+	if parallel <= 0 {
+		parallel = len(hg.Hosts)
+	}
+	if parallel > maxParallel {
+		parallel = maxParallel
+	}
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	parentCtx := hg.Template.Context
+	if parentCtx == nil {
+		parentCtx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	results := make(map[string]Result, len(hg.Hosts))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+
+	for _, host := range hg.Hosts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(host string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if err := ctx.Err(); err != nil {
+				mu.Lock()
+				results[host] = Result{Err: err}
+				mu.Unlock()
+				return
+			}
+
+			hostConfig := hg.Template
+			hostConfig.Host = host
+			hostConfig.Context = ctx
+			// Each host gets its own connection, regardless of whether Template already had one
+			// cached (e.g. a HostGroup built from a Config that was used directly beforehand).
+			hostConfig.client = nil
+			hostConfig.keepaliveDone = nil
+			defer hostConfig.Close()
+
+			start := time.Now()
+			stdout, err := action(&hostConfig)
+			duration := time.Since(start)
+
+			if err != nil && hg.FailFast == true {
+				cancel()
+			}
+
+			mu.Lock()
+			results[host] = Result{Stdout: stdout, Err: err, Duration: duration}
+			mu.Unlock()
+		}(host)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// Run runs cmd on every host in parallel, using ssh.
+func (hg *HostGroup) Run(cmd string) map[string]Result {
+	return hg.dispatch(func(config *Config) (string, error) {
+		return config.Run(cmd)
+	})
+}
+
+// Sudo runs cmd as root on every host in parallel, using sudo over ssh.
+func (hg *HostGroup) Sudo(cmd string) map[string]Result {
+	return hg.dispatch(func(config *Config) (string, error) {
+		return config.Sudo(cmd)
+	})
+}
+
+// Put copies localfiles to remotefile on every host in parallel.
+func (hg *HostGroup) Put(localfiles string, remotefile string) map[string]Result {
+	return hg.dispatch(func(config *Config) (string, error) {
+		return "", config.Put(localfiles, remotefile)
+	})
+}
+
+// Get copies remotefile from every host in parallel into its own subdirectory of localfile, named
+// after the host, so that concurrent fetches from different hosts never overwrite one another:
+// host "db1:22" fetching remotefile lands at localfile/db1_22/<remotefile's base name>.
+func (hg *HostGroup) Get(remotefile string, localfile string) map[string]Result {
+	return hg.dispatch(func(config *Config) (string, error) {
+		hostDir := filepath.Join(localfile, hostDirName(config.Host))
+		// Get treats localfile as a literal destination file unless it already exists as a
+		// directory, so the per-host subdirectory has to exist before Get decides that.
+		if err := os.MkdirAll(hostDir, 0755); err != nil {
+			return "", err
+		}
+		return "", config.Get(remotefile, hostDir)
+	})
+}
+
+// hostDirName turns a Config.Host value (host or host:port) into a string safe to use as a
+// directory name, so Get can give each host its own destination under a shared localfile.
+func hostDirName(host string) string {
+	return strings.ReplaceAll(host, ":", "_")
+}
+
+// PutString generates remotefile containing data on every host in parallel.
+func (hg *HostGroup) PutString(data string, remotefile string) map[string]Result {
+	return hg.dispatch(func(config *Config) (string, error) {
+		return "", config.PutString(data, remotefile)
+	})
+}
@@ -0,0 +1,99 @@
+package loom
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDispatchCapsConcurrency(t *testing.T) {
+	hg := &HostGroup{Hosts: []string{"a", "b", "c", "d"}, Parallel: 2}
+
+	var mu sync.Mutex
+	current, maxSeen := 0, 0
+
+	hg.dispatch(func(config *Config) (string, error) {
+		mu.Lock()
+		current++
+		if current > maxSeen {
+			maxSeen = current
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return "", nil
+	})
+
+	if maxSeen > 2 {
+		t.Errorf("expected Parallel=2 to cap concurrency at 2, saw %d at once", maxSeen)
+	}
+	if maxSeen < 2 {
+		t.Errorf("expected Parallel=2 to actually run 2 hosts at once, only saw %d", maxSeen)
+	}
+}
+
+func TestDispatchFailFastCancelsOutstandingWork(t *testing.T) {
+	hg := &HostGroup{Hosts: []string{"a", "b"}, Parallel: 2, FailFast: true}
+
+	results := hg.dispatch(func(config *Config) (string, error) {
+		if config.Host == "a" {
+			return "", errors.New("boom")
+		}
+		// b either never starts (dispatch's ctx.Err() check short-circuits it once a's error
+		// triggers cancel) or starts and blocks here until that cancellation arrives - either way
+		// it should end up with a non-nil error.
+		<-config.ctx().Done()
+		return "", config.ctx().Err()
+	})
+
+	if results["a"].Err == nil {
+		t.Errorf("expected a's own error to be reported")
+	}
+	if results["b"].Err == nil {
+		t.Errorf("expected FailFast to cancel b's outstanding work")
+	}
+}
+
+func TestHostGroupGetIsolatesPerHostDestination(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "remotedir"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "remotedir", "app.log"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("writing app.log: %s", err)
+	}
+
+	// Two independent fake sftp servers rooted at the same directory stand in for two different
+	// hosts that each happen to have a file at the same remote path.
+	addr1, stop1 := startFakeSFTPServer(t, root)
+	defer stop1()
+	addr2, stop2 := startFakeSFTPServer(t, root)
+	defer stop2()
+
+	localdir := t.TempDir()
+	hg := &HostGroup{
+		Hosts:    []string{addr1, addr2},
+		Template: Config{HostKeyCallback: ssh.InsecureIgnoreHostKey()},
+	}
+
+	results := hg.Get(filepath.Join(root, "remotedir", "app.log"), localdir)
+
+	for _, host := range hg.Hosts {
+		if err := results[host].Err; err != nil {
+			t.Errorf("Get for %s: %s", host, err)
+		}
+		got, err := os.ReadFile(filepath.Join(localdir, hostDirName(host), "app.log"))
+		if err != nil || string(got) != "hello" {
+			t.Errorf("expected %s's fetch under its own subdirectory, got %q, err %v", host, got, err)
+		}
+	}
+}
@@ -5,27 +5,44 @@ It is based on the Python fabric library.
 package loom
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	"code.google.com/p/go.crypto/ssh"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
 )
 
 // Config contains ssh and other configuration data needed for all the public functions in loom.
+//
+// A Config is not safe for concurrent use by more than one goroutine once it has connected: the
+// cached client and keepalive goroutine started by connectClient are unsynchronized state, so two
+// goroutines calling Run/Sudo/Put/Get/PutString on the same *Config race. To run work against
+// multiple hosts (or multiple sessions to one host) in parallel, use HostGroup, which gives each
+// host its own cloned Config, or construct one Config per goroutine yourself.
 type Config struct {
 	// The user name used in SSH connections. If not specified, the current user is assumed.
 	User string
 
 	// Password for SSH connections. This is optional. If the user has an ~/.ssh/id_rsa keyfile,
-	// that will also be tried. In addition, other key files can be specified.
+	// that will also be tried. In addition, other key files can be specified, and if
+	// SSH_AUTH_SOCK is set in the environment, keys loaded in that agent are tried as well.
 	Password string
 
 	// The machine:port to connect to.
@@ -38,8 +55,91 @@ type Config struct {
 	// If true, send command output to stdout.
 	DisplayOutput bool
 
+	// Where Run/Sudo send the remote command's stdout/stderr as it arrives, when DisplayOutput
+	// is true. Default os.Stdout/os.Stderr.
+	Stdout io.Writer
+	Stderr io.Writer
+
 	// If true, errors are fatal and will abort immediately.
 	AbortOnError bool
+
+	// If true, Put/Get/PutString fall back to driving /usr/bin/scp by hand over the legacy
+	// SCP wire protocol, instead of the default SFTP-based transfer. Only needed for servers
+	// old enough to lack an sftp subsystem.
+	ForceSCP bool
+
+	// If true, each session requests SSH agent forwarding, so that commands run via Run/Sudo
+	// can in turn ssh or git clone using the same local agent.
+	ForwardAgent bool
+
+	// An already-unlocked agent to authenticate with, and, if ForwardAgent is set, to forward to
+	// the remote host. If nil and SSH_AUTH_SOCK is set in the environment, that socket is dialed
+	// and used automatically.
+	Agent agent.Agent
+
+	// agentClient is whichever agent was actually used to authenticate the current connection,
+	// either Agent or the one dialed from SSH_AUTH_SOCK. Kept around so ForwardAgent can forward
+	// the same agent that connect used, without dialing SSH_AUTH_SOCK a second time.
+	agentClient agent.Agent
+
+	// Callback used to verify the remote host key. If nil, one is built from KnownHostsFiles and
+	// StrictHostKeyChecking.
+	HostKeyCallback ssh.HostKeyCallback
+
+	// known_hosts files to check and, depending on StrictHostKeyChecking, append newly-seen host
+	// keys to. Defaults to []string{"~/.ssh/known_hosts"}. Only consulted when HostKeyCallback is nil.
+	KnownHostsFiles []string
+
+	// What to do about a host key that isn't in KnownHostsFiles yet: "yes" (the default) rejects
+	// the connection, "ask" prompts on stderr and appends the key if accepted, and "no" accepts
+	// and appends the key silently. A host key that contradicts a known_hosts entry is always
+	// rejected, regardless of this setting. Only consulted when HostKeyCallback is nil.
+	StrictHostKeyChecking string
+
+	// If set, Run/Sudo/Put/Get/PutString abort as soon as it's cancelled: the in-flight session
+	// or transfer is closed and the call returns ctx.Err(). Defaults to context.Background(). The
+	// ForceSCP transfer paths do not watch it.
+	Context context.Context
+
+	// How long to wait for the initial TCP connection. Zero (the default) waits indefinitely,
+	// matching the net.Dialer zero value.
+	ConnectTimeout time.Duration
+
+	// If nonzero, a goroutine sends an SSH keepalive request on this interval for as long as the
+	// connection is open, so long-running recipes survive stateful firewalls that drop idle
+	// connections.
+	KeepAliveInterval time.Duration
+
+	// client is the cached connection opened by the first call to connectClient; every public
+	// method after that just opens a new session on it. Call Close to tear it down. Reading and
+	// writing this field is unsynchronized; see the Config doc comment.
+	client *ssh.Client
+
+	// keepaliveDone, if non-nil, stops the keepalive goroutine started for client when closed.
+	keepaliveDone chan struct{}
+}
+
+// Close tears down the cached *ssh.Client, if one has been established, and stops its keepalive
+// goroutine. A Config can be reused after Close; the next call just reconnects.
+func (config *Config) Close() error {
+	if config.keepaliveDone != nil {
+		close(config.keepaliveDone)
+		config.keepaliveDone = nil
+	}
+	if config.client == nil {
+		return nil
+	}
+	client := config.client
+	config.client = nil
+	return client.Close()
+}
+
+// ctx returns config.Context, defaulting to context.Background().
+func (config *Config) ctx() context.Context {
+	if config.Context != nil {
+		return config.Context
+	}
+	return context.Background()
 }
 
 // parsekey is a private function that reads in a keyfile containing a private key and parses it.
@@ -57,20 +157,74 @@ func parsekey(file string) (ssh.Signer, error) {
 	return private, nil
 }
 
-// connect is a private function to set up the ssh connection. It is called at the beginning of every public
-// function.
-func (config *Config) connect() (*ssh.Session, error) {
+// username returns the user name to authenticate as: config.User if set, otherwise the current
+// OS user.
+func (config *Config) username() (string, error) {
+	if config.User != "" {
+		return config.User, nil
+	}
+	u, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return u.Username, nil
+}
 
-	sshconfig := &ssh.ClientConfig{
-		User: config.User,
+// connectClient is a private function that dials the remote host and performs the SSH handshake.
+// connect and the SFTP-based transfer functions both build on top of this to get at the *ssh.Client.
+// Not safe to call concurrently on the same Config; see the Config doc comment.
+func (config *Config) connectClient() (*ssh.Client, error) {
+	if config.client != nil {
+		return config.client, nil
 	}
 
-	if config.User == "" {
-		u, err := user.Current()
-		if err != nil {
-			return nil, err
+	client, err := config.dial()
+	if err != nil {
+		return nil, err
+	}
+	config.client = client
+
+	if config.KeepAliveInterval > 0 {
+		config.startKeepalive(client)
+	}
+
+	if config.ForwardAgent == true && config.agentClient != nil {
+		// Only needs to happen once per client: it registers a channel handler that serves every
+		// "auth-agent@openssh.com" channel the remote end opens for the life of the connection,
+		// not just the session that happens to request forwarding first.
+		agent.ForwardToAgent(client, config.agentClient)
+	}
+	return client, nil
+}
+
+// startKeepalive spawns a goroutine that sends an SSH keepalive request on client every
+// KeepAliveInterval, until config.Close stops it.
+func (config *Config) startKeepalive(client *ssh.Client) {
+	config.keepaliveDone = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(config.KeepAliveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				client.SendRequest("keepalive@openssh.com", true, nil)
+			case <-config.keepaliveDone:
+				return
+			}
 		}
-		sshconfig.User = u.Username
+	}()
+}
+
+// dial performs a single TCP connection and SSH handshake. connectClient is what callers should
+// use; it caches the result of dial across calls.
+func (config *Config) dial() (*ssh.Client, error) {
+
+	username, err := config.username()
+	if err != nil {
+		return nil, err
+	}
+	sshconfig := &ssh.ClientConfig{
+		User: username,
 	}
 
 	if config.Password != "" {
@@ -97,11 +251,38 @@ func (config *Config) connect() (*ssh.Session, error) {
 		sshconfig.Auth = append(sshconfig.Auth, ssh.PublicKeys(pkey))
 	}
 
+	// Prefer an explicitly injected agent (handy for tests); otherwise, if the user has one
+	// unlocked already, dial SSH_AUTH_SOCK and use that.
+	config.agentClient = config.Agent
+	if config.agentClient == nil {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				config.agentClient = agent.NewClient(conn)
+			}
+		}
+	}
+	if config.agentClient != nil {
+		sshconfig.Auth = append(sshconfig.Auth, ssh.PublicKeysCallback(config.agentClient.Signers))
+	}
+
+	sshconfig.HostKeyCallback = config.HostKeyCallback
+	if sshconfig.HostKeyCallback == nil {
+		sshconfig.HostKeyCallback, err = config.knownHostsCallback()
+		if err != nil {
+			if config.AbortOnError == true {
+				log.Fatalf("%s", err)
+			}
+			return nil, err
+		}
+	}
+
 	host := config.Host
 	if strings.Contains(host, ":") == false {
 		host = host + ":22"
 	}
-	client, err := ssh.Dial("tcp", host, sshconfig)
+
+	dialer := net.Dialer{Timeout: config.ConnectTimeout}
+	conn, err := dialer.Dial("tcp", host)
 	if err != nil {
 		if config.AbortOnError == true {
 			log.Fatalf("%s", err)
@@ -109,6 +290,129 @@ func (config *Config) connect() (*ssh.Session, error) {
 		return nil, err
 	}
 
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, host, sshconfig)
+	if err != nil {
+		conn.Close()
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return nil, err
+	}
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// knownHostsCallback builds an ssh.HostKeyCallback from config.KnownHostsFiles, handling unknown
+// hosts according to config.StrictHostKeyChecking.
+func (config *Config) knownHostsCallback() (ssh.HostKeyCallback, error) {
+	files := config.KnownHostsFiles
+	if len(files) == 0 {
+		files = []string{os.Getenv("HOME") + "/.ssh/known_hosts"}
+	}
+
+	// knownhosts.New opens every file and fails if any of them is missing, which would make a
+	// host's very first connection impossible to accept: there's nothing yet for appendKnownHost
+	// to add to. Create any missing file, empty, before handing the list to it.
+	if err := ensureFilesExist(files); err != nil {
+		return nil, err
+	}
+
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+
+	strictChecking := config.StrictHostKeyChecking
+	if strictChecking == "" {
+		strictChecking = "yes"
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok || len(keyErr.Want) > 0 {
+			// Either no error, or the host key doesn't match one we already trust: always an
+			// error, since that's the signature of a man-in-the-middle.
+			return err
+		}
+
+		// The host just isn't in any known_hosts file yet.
+		switch strictChecking {
+		case "no":
+			return appendKnownHost(files, hostname, key)
+		case "ask":
+			if promptAcceptHostKey(hostname, key) == false {
+				return err
+			}
+			return appendKnownHost(files, hostname, key)
+		default:
+			return err
+		}
+	}, nil
+}
+
+// promptAcceptHostKey asks the user on stderr/stdin whether to trust a new host key.
+func promptAcceptHostKey(hostname string, key ssh.PublicKey) bool {
+	fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ", hostname, key.Type(), ssh.FingerprintSHA256(key))
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(strings.ToLower(answer)) == "yes"
+}
+
+// appendKnownHost appends hostname's key, in known_hosts line format, to the first file in files
+// that can be opened for writing.
+func appendKnownHost(files []string, hostname string, key ssh.PublicKey) error {
+	line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key) + "\n"
+
+	var lastErr error
+	for _, name := range files {
+		f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		_, err = f.WriteString(line)
+		f.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no writable known_hosts file in %v", files)
+	}
+	return lastErr
+}
+
+// ensureFilesExist creates any file in files that doesn't already exist, empty, including its
+// parent directory. It's not an error for a file to already exist.
+func ensureFilesExist(files []string) error {
+	for _, name := range files {
+		if _, err := os.Stat(name); err == nil {
+			continue
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// connect is a private function to set up the ssh connection. It is called at the beginning of every public
+// function that only needs a single session.
+func (config *Config) connect() (*ssh.Session, error) {
+
+	client, err := config.connectClient()
+	if err != nil {
+		return nil, err
+	}
+
 	session, err := client.NewSession()
 	if err != nil {
 		if config.AbortOnError == true {
@@ -116,9 +420,36 @@ func (config *Config) connect() (*ssh.Session, error) {
 		}
 		return nil, err
 	}
+
+	if config.ForwardAgent == true && config.agentClient != nil {
+		// The client-wide side of forwarding (agent.ForwardToAgent) is set up once, in
+		// connectClient, when the client is first established.
+		agent.RequestAgentForwarding(session)
+	}
 	return session, err
 }
 
+// sudoMatcher watches chunks of output as they arrive and reports whether they contain a sudo
+// password prompt for a given user. Output can be split across chunks at an arbitrary point (an
+// earlier chunk might end mid-prompt), so sudoMatcher accumulates everything it's seen rather than
+// matching each chunk in isolation.
+type sudoMatcher struct {
+	prompt string
+	seen   bytes.Buffer
+}
+
+// newSudoMatcher returns a sudoMatcher looking for the sudo password prompt for user.
+func newSudoMatcher(user string) *sudoMatcher {
+	return &sudoMatcher{prompt: fmt.Sprintf("[sudo] password for %s:", user)}
+}
+
+// Match feeds chunk into the matcher and reports whether the sudo password prompt has been seen
+// yet, across this and any previous calls.
+func (sm *sudoMatcher) Match(chunk []byte) bool {
+	sm.seen.Write(chunk)
+	return strings.Contains(sm.seen.String(), sm.prompt)
+}
+
 // doRun is called by both Run() and Sudo() to execute a command.
 func (config *Config) doRun(cmd string, sudo bool) (string, error) {
 
@@ -131,7 +462,21 @@ func (config *Config) doRun(cmd string, sudo bool) (string, error) {
 	}
 	defer session.Close()
 
-	// Set up terminal modes
+	ctx := config.ctx()
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				session.Close()
+			case <-stop:
+			}
+		}()
+	}
+
+	// Set up terminal modes. ECHO stays disabled for the life of the session, which is also what
+	// keeps the sudo password written to stdin below from being echoed back into our own output.
 	modes := ssh.TerminalModes{
 		ssh.ECHO:          0,     // disable echoing
 		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
@@ -149,23 +494,120 @@ func (config *Config) doRun(cmd string, sudo bool) (string, error) {
 		cmd = fmt.Sprintf("/usr/bin/sudo bash <<CMD\nexport PATH=/usr/local/sbin:/usr/local/bin:/sbin:/bin:/usr/sbin:/usr/bin:/root/bin\n%s\nCMD", cmd)
 	}
 
-	// TODO: use pipes instead of CombinedOutput so that we can show the output of commands more interactively, instead
-	// of now, which is after they're completely done executing.
-	output, err := session.CombinedOutput(cmd)
+	stdin, err := session.StdinPipe()
 	if err != nil {
-		if config.DisplayOutput == true && len(output) > 0 {
-			fmt.Printf("%s", string(output))
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
 		}
+		return "", err
+	}
+	stdoutPipe, err := session.StdoutPipe()
+	if err != nil {
 		if config.AbortOnError == true {
 			log.Fatalf("%s", err)
 		}
 		return "", err
 	}
-	session.SendRequest("close", false, nil)
-	if config.DisplayOutput == true {
-		fmt.Printf("%s", string(output))
+	stderrPipe, err := session.StderrPipe()
+	if err != nil {
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return "", err
+	}
+
+	displayStdout := config.Stdout
+	if displayStdout == nil {
+		displayStdout = os.Stdout
+	}
+	displayStderr := config.Stderr
+	if displayStderr == nil {
+		displayStderr = os.Stderr
+	}
+
+	var matcher *sudoMatcher
+	if sudo == true && config.Password != "" {
+		if uname, err := config.username(); err == nil {
+			matcher = newSudoMatcher(uname)
+		}
+	}
+
+	var mu sync.Mutex
+	var output bytes.Buffer
+	var passwordSent bool
+
+	// tee copies r to w and to output as raw chunks, not lines: a sudo password prompt arrives
+	// with no trailing newline and then blocks waiting for stdin, so waiting for a line (e.g. via
+	// bufio.Scanner) would never see it. matcher.Match runs on every chunk as it arrives so the
+	// password can be written the instant the prompt shows up. Lines are only reassembled for
+	// DisplayOutput, which can afford to wait for a newline.
+	tee := func(r io.Reader, w io.Writer) {
+		buf := make([]byte, 4096)
+		var lineBuf bytes.Buffer
+		for {
+			n, readErr := r.Read(buf)
+			if n > 0 {
+				chunk := buf[:n]
+
+				mu.Lock()
+				output.Write(chunk)
+				if matcher != nil && passwordSent == false && matcher.Match(chunk) {
+					passwordSent = true
+					fmt.Fprintf(stdin, "%s\n", config.Password)
+				}
+				mu.Unlock()
+
+				if config.DisplayOutput == true {
+					lineBuf.Write(chunk)
+					for {
+						line, err := lineBuf.ReadString('\n')
+						if err != nil {
+							lineBuf.Reset()
+							lineBuf.WriteString(line)
+							break
+						}
+						fmt.Fprint(w, line)
+					}
+				}
+			}
+			if readErr != nil {
+				if config.DisplayOutput == true && lineBuf.Len() > 0 {
+					fmt.Fprint(w, lineBuf.String())
+				}
+				return
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		tee(stdoutPipe, displayStdout)
+	}()
+	go func() {
+		defer wg.Done()
+		tee(stderrPipe, displayStderr)
+	}()
+
+	if err = session.Start(cmd); err != nil {
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return "", err
 	}
-	return string(output), nil
+
+	wg.Wait()
+	if err = session.Wait(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return output.String(), err
+	}
+	return output.String(), nil
 }
 
 // Run takes a command and runs it on the remote host, using ssh.
@@ -184,9 +626,349 @@ func (config *Config) Sudo(cmd string) (string, error) {
 	return config.doRun(cmd, true)
 }
 
-// Put copies one or more local files to the remote host, using scp. localfiles can
-// contain wildcards, and remotefile can be either a directory or a file.
+// newSFTPClient opens an SFTP session on top of the cached connection from connectClient. The
+// caller is responsible for closing the returned client, which closes only the SFTP session; the
+// underlying ssh.Client stays cached on config until config.Close.
+func (config *Config) newSFTPClient() (*sftp.Client, error) {
+	client, err := config.connectClient()
+	if err != nil {
+		return nil, err
+	}
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		// client is the cached config.client, not a private connection, so closing it directly
+		// would leave the cache pointing at a dead connection for every later call on this Config.
+		// config.Close clears the cache too, so the next call just reconnects.
+		config.Close()
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return nil, err
+	}
+	return sftpClient, nil
+}
+
+// copyWithContext copies src to dst, aborting early if ctx is cancelled before the copy finishes.
+// It mirrors the close-on-cancel pattern doRun uses for sessions: a watcher goroutine closes rf,
+// the remote file on the other end of the copy, the moment ctx is done, which unblocks the read or
+// write io.Copy is parked on. This is what makes Put/Get of a single large file cancellable
+// mid-transfer rather than only in between files.
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader, rf io.Closer) error {
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				rf.Close()
+			case <-stop:
+			}
+		}()
+	}
+	_, err := io.Copy(dst, src)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// Put copies one or more local files to the remote host. localfiles can contain wildcards, and
+// remotefile can be either a directory or a file. Directories are copied recursively, preserving
+// permissions and modification times.
 func (config *Config) Put(localfiles string, remotefile string) error {
+	if config.ForceSCP == true {
+		return config.putSCP(localfiles, remotefile)
+	}
+	return config.putSFTP(localfiles, remotefile)
+}
+
+func (config *Config) putSFTP(localfiles string, remotefile string) error {
+
+	files, err := filepath.Glob(localfiles)
+	if err != nil {
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return err
+	}
+	if len(files) == 0 {
+		err = fmt.Errorf("No files match %s", localfiles)
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return err
+	}
+
+	sftpClient, err := config.newSFTPClient()
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	ctx := config.ctx()
+	for _, localfile := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if config.DisplayOutput == true {
+			fmt.Printf("put: %s %s\n", localfile, remotefile)
+		}
+
+		fi, err := os.Stat(localfile)
+		if err != nil {
+			if config.AbortOnError == true {
+				log.Fatalf("%s", err)
+			}
+			return err
+		}
+
+		if fi.IsDir() == true {
+			err = putDirSFTP(ctx, sftpClient, localfile, remotePutTarget(sftpClient, remotefile, filepath.Base(localfile)))
+		} else {
+			err = putFileSFTP(ctx, sftpClient, localfile, remotefile, fi)
+		}
+		if err != nil {
+			if config.AbortOnError == true {
+				log.Fatalf("%s", err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remotePutTarget works out the final remote path for a local file or directory being copied to
+// remotefile: if remotefile already exists as a directory, the local base name is appended to it.
+func remotePutTarget(sftpClient *sftp.Client, remotefile string, basename string) string {
+	if fi, err := sftpClient.Stat(remotefile); err == nil && fi.IsDir() == true {
+		return path.Join(remotefile, basename)
+	}
+	return remotefile
+}
+
+// putFileSFTP copies a single local file to the remote host, preserving its mode and mtime. The
+// copy itself is cancellable mid-transfer via ctx, not just in between files.
+func putFileSFTP(ctx context.Context, sftpClient *sftp.Client, localfile string, remotefile string, fi os.FileInfo) error {
+	target := remotePutTarget(sftpClient, remotefile, filepath.Base(localfile))
+
+	lf, err := os.Open(localfile)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	rf, err := sftpClient.Create(target)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+
+	if err = copyWithContext(ctx, rf, lf, rf); err != nil {
+		return err
+	}
+	if err = sftpClient.Chmod(target, fi.Mode()&os.ModePerm); err != nil {
+		return err
+	}
+	return sftpClient.Chtimes(target, fi.ModTime(), fi.ModTime())
+}
+
+// putDirSFTP recursively copies a local directory to the remote host, creating directories as
+// needed and preserving permissions and modification times along the way.
+func putDirSFTP(ctx context.Context, sftpClient *sftp.Client, localdir string, remotedir string) error {
+	if err := sftpClient.MkdirAll(remotedir); err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(localdir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		localpath := filepath.Join(localdir, entry.Name())
+		remotepath := path.Join(remotedir, entry.Name())
+		if entry.IsDir() == true {
+			if err = putDirSFTP(ctx, sftpClient, localpath, remotepath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = putFileSFTP(ctx, sftpClient, localpath, remotepath, entry); err != nil {
+			return err
+		}
+	}
+	return sftpClient.Chmod(remotedir, entries2Mode(localdir))
+}
+
+// entries2Mode returns the mode bits of a local directory, falling back to 0755 if they can't be read.
+func entries2Mode(localdir string) os.FileMode {
+	fi, err := os.Stat(localdir)
+	if err != nil {
+		return 0755
+	}
+	return fi.Mode() & os.ModePerm
+}
+
+// PutString generates a new file on the remote host containing data. The file is created with mode 0644.
+func (config *Config) PutString(data string, remotefile string) error {
+	if config.ForceSCP == true {
+		return config.putStringSCP(data, remotefile)
+	}
+
+	if config.DisplayOutput == true {
+		fmt.Printf("putstring: %s\n", remotefile)
+	}
+
+	sftpClient, err := config.newSFTPClient()
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	rf, err := sftpClient.Create(remotefile)
+	if err != nil {
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return err
+	}
+	defer rf.Close()
+
+	if err = copyWithContext(config.ctx(), rf, strings.NewReader(data), rf); err != nil {
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return err
+	}
+	return sftpClient.Chmod(remotefile, 0644)
+}
+
+// Get copies one or more files from the remote host to the local host. remotefile may contain
+// wildcards; localfile can be either a directory or a file.
+func (config *Config) Get(remotefile string, localfile string) error {
+	if config.ForceSCP == true {
+		return config.getSCP(remotefile, localfile)
+	}
+
+	if config.DisplayOutput == true {
+		fmt.Printf("get: %s %s\n", remotefile, localfile)
+	}
+
+	sftpClient, err := config.newSFTPClient()
+	if err != nil {
+		return err
+	}
+	defer sftpClient.Close()
+
+	matches, err := sftpClient.Glob(remotefile)
+	if err != nil {
+		if config.AbortOnError == true {
+			log.Fatalf("%s", err)
+		}
+		return err
+	}
+	if len(matches) == 0 {
+		// remotefile had no glob metacharacters, or genuinely didn't match; try it literally
+		// so the caller gets a normal stat error below instead of a silent no-op.
+		matches = []string{remotefile}
+	}
+
+	ctx := config.ctx()
+	for _, rfile := range matches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fi, err := sftpClient.Stat(rfile)
+		if err != nil {
+			if config.AbortOnError == true {
+				log.Fatalf("%s", err)
+			}
+			return err
+		}
+		if fi.IsDir() == true {
+			err = getDirSFTP(ctx, sftpClient, rfile, localfile)
+		} else {
+			err = getFileSFTP(ctx, sftpClient, rfile, localfile, fi)
+		}
+		if err != nil {
+			if config.AbortOnError == true {
+				log.Fatalf("%s", err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// localGetTarget works out the final local path for a remote file or directory being fetched to
+// localfile: if localfile already exists as a directory, the remote base name is appended to it.
+func localGetTarget(remotefile string, localfile string) string {
+	if fi, err := os.Stat(localfile); err == nil && fi.IsDir() == true {
+		return filepath.Join(localfile, path.Base(remotefile))
+	}
+	return localfile
+}
+
+// getFileSFTP copies a single remote file to the local host, preserving its mode. The copy itself
+// is cancellable mid-transfer via ctx, not just in between files.
+func getFileSFTP(ctx context.Context, sftpClient *sftp.Client, remotefile string, localfile string, fi os.FileInfo) error {
+	target := localGetTarget(remotefile, localfile)
+
+	rf, err := sftpClient.Open(remotefile)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+
+	if err = os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	lf, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+
+	return copyWithContext(ctx, lf, rf, rf)
+}
+
+// getDirSFTP recursively copies a remote directory to the local host.
+func getDirSFTP(ctx context.Context, sftpClient *sftp.Client, remotedir string, localdir string) error {
+	target := localGetTarget(remotedir, localdir)
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return err
+	}
+
+	entries, err := sftpClient.ReadDir(remotedir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		remotepath := path.Join(remotedir, entry.Name())
+		localpath := filepath.Join(target, entry.Name())
+		if entry.IsDir() == true {
+			if err = getDirSFTP(ctx, sftpClient, remotepath, localpath); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = getFileSFTP(ctx, sftpClient, remotepath, localpath, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putSCP copies one or more local files to the remote host by driving /usr/bin/scp over the
+// legacy SCP wire protocol directly. localfiles can contain wildcards, and remotefile can be
+// either a directory or a file. Kept around for ForceSCP; prefer Put, which uses SFTP.
+func (config *Config) putSCP(localfiles string, remotefile string) error {
 
 	files, err := filepath.Glob(localfiles)
 	if err != nil {
@@ -274,8 +1056,10 @@ func (config *Config) Put(localfiles string, remotefile string) error {
 	return nil
 }
 
-// PutString generates a new file on the remote host containing data. The file is created with mode 0644.
-func (config *Config) PutString(data string, remotefile string) error {
+// putStringSCP generates a new file on the remote host containing data, using the legacy SCP
+// wire protocol directly. The file is created with mode 0644. Kept around for ForceSCP; prefer
+// PutString, which uses SFTP.
+func (config *Config) putStringSCP(data string, remotefile string) error {
 
 	if config.DisplayOutput == true {
 		fmt.Printf("putstring: %s\n", remotefile)
@@ -328,8 +1112,10 @@ func (config *Config) PutString(data string, remotefile string) error {
 	return nil
 }
 
-// Get copies the file from the remote host to the local host, using scp. Wildcards are not currently supported.
-func (config *Config) Get(remotefile string, localfile string) error {
+// getSCP copies the file from the remote host to the local host, using the legacy SCP wire
+// protocol directly. Wildcards are not supported. Kept around for ForceSCP; prefer Get, which
+// uses SFTP.
+func (config *Config) getSCP(remotefile string, localfile string) error {
 
 	if config.DisplayOutput == true {
 		fmt.Printf("get: %s %s\n", remotefile, localfile)
@@ -0,0 +1,185 @@
+package loom
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startFakeSFTPServer listens on 127.0.0.1:0 and serves a real github.com/pkg/sftp subsystem over
+// an authless SSH connection, rooted at the local filesystem. Since the test process is both
+// client and server, remote paths handed to Put/Get are just ordinary local paths under root.
+func startFakeSFTPServer(t *testing.T, root string) (addr string, stop func()) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating host key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatalf("wrapping host key: %s", err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeSFTPConn(conn, serverConfig, root)
+		}
+	}()
+
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// serveFakeSFTPConn handles one SSH connection, accepting every session channel and handing each
+// off to a real sftp.Server rooted at root. Any subsystem request on a channel is accepted.
+func serveFakeSFTPConn(conn net.Conn, serverConfig *ssh.ServerConfig, root string) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				req.Reply(req.Type == "subsystem", nil)
+			}
+		}()
+		go func() {
+			defer channel.Close()
+			server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(root))
+			if err != nil {
+				return
+			}
+			server.Serve()
+		}()
+	}
+	sconn.Wait()
+}
+
+func newFakeSFTPConfig(t *testing.T, addr string) *Config {
+	t.Helper()
+	return &Config{
+		Host:            addr,
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+}
+
+func TestPutSFTPCopiesDirectoryRecursively(t *testing.T) {
+	root := t.TempDir()
+	addr, stop := startFakeSFTPServer(t, root)
+	defer stop()
+
+	localdir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(localdir, "sub"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(localdir, "a.txt"), []byte("top-level"), 0644); err != nil {
+		t.Fatalf("writing a.txt: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(localdir, "sub", "b.txt"), []byte("nested"), 0640); err != nil {
+		t.Fatalf("writing b.txt: %s", err)
+	}
+
+	config := newFakeSFTPConfig(t, addr)
+	if err := config.Put(localdir, filepath.Join(root, "uploaded")); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	top, err := os.ReadFile(filepath.Join(root, "uploaded", "a.txt"))
+	if err != nil || string(top) != "top-level" {
+		t.Errorf("a.txt not copied correctly: %q, err %v", top, err)
+	}
+	nested, err := os.ReadFile(filepath.Join(root, "uploaded", "sub", "b.txt"))
+	if err != nil || string(nested) != "nested" {
+		t.Errorf("sub/b.txt not copied correctly: %q, err %v", nested, err)
+	}
+}
+
+func TestPutSFTPExpandsWildcards(t *testing.T) {
+	root := t.TempDir()
+	addr, stop := startFakeSFTPServer(t, root)
+	defer stop()
+
+	localdir := t.TempDir()
+	for _, name := range []string{"one.log", "two.log", "three.txt"} {
+		if err := os.WriteFile(filepath.Join(localdir, name), []byte(name), 0644); err != nil {
+			t.Fatalf("writing %s: %s", name, err)
+		}
+	}
+
+	remotedir := filepath.Join(root, "logs")
+	if err := os.MkdirAll(remotedir, 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+
+	config := newFakeSFTPConfig(t, addr)
+	if err := config.Put(filepath.Join(localdir, "*.log"), remotedir+"/"); err != nil {
+		t.Fatalf("Put: %s", err)
+	}
+
+	for _, name := range []string{"one.log", "two.log"} {
+		if _, err := os.Stat(filepath.Join(remotedir, name)); err != nil {
+			t.Errorf("expected %s to be uploaded: %s", name, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remotedir, "three.txt")); err == nil {
+		t.Errorf("three.txt should not have matched the *.log glob")
+	}
+}
+
+func TestGetSFTPCopiesDirectoryRecursively(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "remotedir", "sub"), 0755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "remotedir", "a.txt"), []byte("top-level"), 0644); err != nil {
+		t.Fatalf("writing a.txt: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "remotedir", "sub", "b.txt"), []byte("nested"), 0644); err != nil {
+		t.Fatalf("writing b.txt: %s", err)
+	}
+
+	addr, stop := startFakeSFTPServer(t, root)
+	defer stop()
+
+	localdir := t.TempDir()
+	config := newFakeSFTPConfig(t, addr)
+	if err := config.Get(filepath.Join(root, "remotedir"), localdir); err != nil {
+		t.Fatalf("Get: %s", err)
+	}
+
+	top, err := os.ReadFile(filepath.Join(localdir, "remotedir", "a.txt"))
+	if err != nil || string(top) != "top-level" {
+		t.Errorf("a.txt not fetched correctly: %q, err %v", top, err)
+	}
+	nested, err := os.ReadFile(filepath.Join(localdir, "remotedir", "sub", "b.txt"))
+	if err != nil || string(nested) != "nested" {
+		t.Errorf("sub/b.txt not fetched correctly: %q, err %v", nested, err)
+	}
+}